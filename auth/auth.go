@@ -0,0 +1,279 @@
+// Package auth implements just enough of AWS Signature Version 4 to gate
+// the mirror's HTTP endpoints behind a set of locally issued access keys,
+// without depending on an AWS SDK signer (the mirror is not the one calling
+// S3 here, it is the one being called).
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	algorithm    = "AWS4-HMAC-SHA256"
+	service      = "s3"
+	maxClockSkew = 5 * time.Minute
+)
+
+// Keys maps an access key ID to its secret.
+type Keys map[string]string
+
+// ParseKeys parses the comma-separated "keyID:secret" pairs carried by the
+// MIRROR_ACCESS_KEYS environment variable. An empty string yields an empty,
+// valid Keys (authentication is then simply not enforced).
+func ParseKeys(s string) (Keys, error) {
+	ks := Keys{}
+	if s == "" {
+		return ks, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, ":", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid MIRROR_ACCESS_KEYS pair: %q", pair)
+		}
+		ks[kv[0]] = kv[1]
+	}
+	return ks, nil
+}
+
+type signature struct {
+	keyID         string
+	date          string
+	region        string
+	signedHeaders []string
+	signature     string
+	amzDate       string
+	payloadHash   string
+	// presigned and expires are only set for a presigned query string
+	// (X-Amz-Signature): the request is valid until signTime+expires
+	// rather than within the usual clock-skew window.
+	presigned bool
+	expires   time.Duration
+}
+
+// Verify checks r against a SigV4 signature, either carried in the
+// Authorization header or as a presigned query string (X-Amz-Signature). It
+// returns an error describing why the request was rejected.
+func (ks Keys) Verify(r *http.Request) error {
+	sig, err := parseSignature(r)
+	if err != nil {
+		return err
+	}
+
+	secret, ok := ks[sig.keyID]
+	if !ok {
+		return fmt.Errorf("unknown access key: %s", sig.keyID)
+	}
+
+	t, err := time.Parse("20060102T150405Z", sig.amzDate)
+	if err != nil {
+		return fmt.Errorf("invalid x-amz-date: %w", err)
+	}
+	if sig.presigned {
+		if now := time.Now(); now.Before(t.Add(-maxClockSkew)) {
+			return fmt.Errorf("request clock skew too large")
+		} else if now.After(t.Add(sig.expires)) {
+			return fmt.Errorf("presigned URL expired at %s", t.Add(sig.expires))
+		}
+	} else if d := time.Since(t); d > maxClockSkew || d < -maxClockSkew {
+		return fmt.Errorf("request clock skew too large: %s", d)
+	}
+
+	expected := sig.sign(r, secret)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(sig.signature)) != 1 {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
+
+// parseSignature extracts the signature fields from either the
+// Authorization header or the presigned query string.
+func parseSignature(r *http.Request) (signature, error) {
+	if q := r.URL.Query().Get("X-Amz-Signature"); q != "" {
+		return parsePresignedSignature(r, q)
+	}
+	return parseHeaderSignature(r)
+}
+
+func parseHeaderSignature(r *http.Request) (signature, error) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, algorithm+" ") {
+		return signature{}, fmt.Errorf("missing or unsupported Authorization header")
+	}
+
+	var sig signature
+	for _, part := range strings.Split(strings.TrimPrefix(h, algorithm+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return signature{}, fmt.Errorf("malformed Authorization header")
+		}
+		switch kv[0] {
+		case "Credential":
+			scope := strings.Split(kv[1], "/")
+			if len(scope) != 5 || scope[3] != service || scope[4] != "aws4_request" {
+				return signature{}, fmt.Errorf("malformed credential scope: %q", kv[1])
+			}
+			sig.keyID, sig.date, sig.region = scope[0], scope[1], scope[2]
+		case "SignedHeaders":
+			sig.signedHeaders = strings.Split(kv[1], ";")
+		case "Signature":
+			sig.signature = kv[1]
+		}
+	}
+	if sig.keyID == "" || sig.signature == "" || len(sig.signedHeaders) == 0 {
+		return signature{}, fmt.Errorf("incomplete Authorization header")
+	}
+
+	sig.amzDate = r.Header.Get("X-Amz-Date")
+	if sig.amzDate == "" {
+		return signature{}, fmt.Errorf("missing X-Amz-Date header")
+	}
+	sig.payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+	if sig.payloadHash == "" {
+		sig.payloadHash = hashPayload(nil)
+	}
+	return sig, nil
+}
+
+func parsePresignedSignature(r *http.Request, sigValue string) (signature, error) {
+	q := r.URL.Query()
+	if q.Get("X-Amz-Algorithm") != algorithm {
+		return signature{}, fmt.Errorf("unsupported X-Amz-Algorithm: %q", q.Get("X-Amz-Algorithm"))
+	}
+	scope := strings.Split(q.Get("X-Amz-Credential"), "/")
+	if len(scope) != 5 || scope[3] != service || scope[4] != "aws4_request" {
+		return signature{}, fmt.Errorf("malformed X-Amz-Credential: %q", q.Get("X-Amz-Credential"))
+	}
+	signedHeaders := q.Get("X-Amz-SignedHeaders")
+	if signedHeaders == "" {
+		return signature{}, fmt.Errorf("missing X-Amz-SignedHeaders")
+	}
+	amzDate := q.Get("X-Amz-Date")
+	if amzDate == "" {
+		return signature{}, fmt.Errorf("missing X-Amz-Date")
+	}
+	expiresIn, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+	if err != nil || expiresIn <= 0 {
+		return signature{}, fmt.Errorf("missing or invalid X-Amz-Expires: %q", q.Get("X-Amz-Expires"))
+	}
+	return signature{
+		keyID:         scope[0],
+		date:          scope[1],
+		region:        scope[2],
+		signedHeaders: strings.Split(signedHeaders, ";"),
+		signature:     sigValue,
+		amzDate:       amzDate,
+		payloadHash:   "UNSIGNED-PAYLOAD",
+		presigned:     true,
+		expires:       time.Duration(expiresIn) * time.Second,
+	}, nil
+}
+
+// sign recomputes the SigV4 signature for r under the given secret,
+// following the canonical request -> string to sign -> signing key chain.
+func (sig signature) sign(r *http.Request, secret string) string {
+	canonical := sig.canonicalRequest(r)
+	hash := sha256Hex([]byte(canonical))
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", sig.date, sig.region, service)
+	toSign := strings.Join([]string{algorithm, sig.amzDate, scope, hash}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secret), sig.date)
+	key = hmacSHA256(key, sig.region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func (sig signature) canonicalRequest(r *http.Request) string {
+	headers := make([]string, len(sig.signedHeaders))
+	copy(headers, sig.signedHeaders)
+	sort.Strings(headers)
+
+	var canonicalHeaders strings.Builder
+	for _, h := range headers {
+		v := r.Header.Get(h)
+		if strings.EqualFold(h, "host") && v == "" {
+			v = r.Host
+		}
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", strings.ToLower(h), strings.TrimSpace(v))
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		canonicalURI(r.URL.Path),
+		canonicalQueryString(r.URL.Query()),
+		canonicalHeaders.String(),
+		strings.Join(headers, ";"),
+		sig.payloadHash,
+	}, "\n")
+}
+
+func canonicalURI(p string) string {
+	if p == "" {
+		return "/"
+	}
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+func canonicalQueryString(q url.Values) string {
+	ks := make([]string, 0, len(q))
+	for k := range q {
+		if k == "X-Amz-Signature" {
+			continue
+		}
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+
+	parts := make([]string, 0, len(ks))
+	for _, k := range ks {
+		vs := append([]string{}, q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, rfc3986Escape(k)+"="+rfc3986Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// rfc3986Escape percent-encodes s the way SigV4 canonicalization requires:
+// unreserved characters (ALPHA / DIGIT / "-" / "." / "_" / "~") are left as
+// is, everything else -- including a space, which url.QueryEscape turns
+// into "+" -- is percent-encoded.
+func rfc3986Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hashPayload(b []byte) string {
+	return sha256Hex(b)
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
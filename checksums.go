@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// checksumAlgorithms is the order /checksums.txt reports its digest
+// sections in.
+var checksumAlgorithms = []string{"sha256", "md5"}
+
+// handleChecksums serves /checksums.txt: every file that has a usable
+// digest (a x-amz-meta-sha256 tag or a plain, non-multipart ETag), grouped
+// into one "# <algorithm>" section per digest kind so a sha256sum -c or
+// md5sum -c run against a section sees only digests of its own algorithm --
+// an ETag is an MD5, not a sha256, and the two checksum formats are not
+// interchangeable.
+func (c *Cache) handleChecksums(w http.ResponseWriter) {
+	c.mu.RLock()
+	fs := make([]File, len(c.Files))
+	copy(fs, c.Files)
+	c.mu.RUnlock()
+
+	sort.Slice(fs, func(i, j int) bool { return fs[i].name < fs[j].name })
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, algorithm := range checksumAlgorithms {
+		var lines []string
+		for _, f := range fs {
+			if digest, a := f.checksum(); a == algorithm {
+				lines = append(lines, fmt.Sprintf("%s  %s", digest, f.name))
+			}
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "# %s\n", algorithm)
+		for _, l := range lines {
+			fmt.Fprintln(w, l)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// healthResponse is the JSON body served at /healthz.
+type healthResponse struct {
+	CreatedAt          string  `json:"createdAt"`
+	LastRefreshSeconds float64 `json:"lastRefreshSeconds"`
+	LastRefreshError   string  `json:"lastRefreshError,omitempty"`
+	Objects            int     `json:"objects"`
+	Bytes              int64   `json:"bytes"`
+}
+
+func (c *Cache) handleHealthz(w http.ResponseWriter) {
+	s := c.stats()
+	res := healthResponse{
+		CreatedAt:          s.createdAt.Format(http.TimeFormat),
+		LastRefreshSeconds: s.lastRefreshDuration.Seconds(),
+		Objects:            s.objects,
+		Bytes:              s.bytes,
+	}
+	if s.lastRefreshErr != nil {
+		res.LastRefreshError = s.lastRefreshErr.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// handleMetrics serves a minimal Prometheus text-format exposition of the
+// cache's refresh health.
+func (c *Cache) handleMetrics(w http.ResponseWriter) {
+	s := c.stats()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP mirror_refresh_seconds Duration of the last cache refresh, in seconds.\n")
+	fmt.Fprintf(w, "# TYPE mirror_refresh_seconds gauge\n")
+	fmt.Fprintf(w, "mirror_refresh_seconds %f\n", s.lastRefreshDuration.Seconds())
+
+	fmt.Fprintf(w, "# HELP mirror_objects_total Number of objects in the cached bucket listing.\n")
+	fmt.Fprintf(w, "# TYPE mirror_objects_total gauge\n")
+	fmt.Fprintf(w, "mirror_objects_total %d\n", s.objects)
+
+	fmt.Fprintf(w, "# HELP mirror_bytes_total Total size, in bytes, of the cached bucket listing.\n")
+	fmt.Fprintf(w, "# TYPE mirror_bytes_total gauge\n")
+	fmt.Fprintf(w, "mirror_bytes_total %d\n", s.bytes)
+
+	fmt.Fprintf(w, "# HELP mirror_refresh_errors_total Number of cache refreshes that failed.\n")
+	fmt.Fprintf(w, "# TYPE mirror_refresh_errors_total counter\n")
+	fmt.Fprintf(w, "mirror_refresh_errors_total %d\n", c.refreshErrorsTotal.Load())
+}
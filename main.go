@@ -7,20 +7,32 @@ import (
 	"fmt"
 	"html/template"
 	"log"
+	"mime"
 	"net/http"
 	"os"
+	"path"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/cuducos/minha-receita-mirror/auth"
 )
 
 const (
-	cacheExpiration = 12 * time.Hour
+	// staleAfter is how long the cache is served as-is before a background
+	// refresh is triggered.
+	staleAfter = 12 * time.Hour
+	// hardExpireAfter is how long a cache that keeps failing to refresh is
+	// still served before requests start failing with 503.
+	hardExpireAfter = 72 * time.Hour
 	unit            = 1024
 )
 
@@ -63,12 +75,30 @@ func newSettings() (settings, error) {
 }
 
 type File struct {
-	URL            string `json:"url"`
-	Size           int64  `json:"size"`
+	URL            string            `json:"url"`
+	Size           int64             `json:"size"`
+	ETag           string            `json:"etag,omitempty"`
+	ContentType    string            `json:"contentType,omitempty"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
 	name           string
 	lastModifiedAt time.Time
 }
 
+// checksum returns the digest used to verify a download -- the ETag when it
+// is a plain MD5 (i.e. the object was not uploaded as a multipart upload),
+// or a sha256 the uploader stashed in the x-amz-meta-sha256 tag otherwise --
+// together with which of the two algorithms it is, since md5sum and
+// sha256sum checksum files are not interchangeable.
+func (f *File) checksum() (digest, algorithm string) {
+	if f.ETag != "" && !strings.Contains(f.ETag, "-") {
+		return f.ETag, "md5"
+	}
+	if sha256 := f.Metadata["sha256"]; sha256 != "" {
+		return sha256, "sha256"
+	}
+	return "", ""
+}
+
 func (f *File) HumanReadableSize() string {
 	if f.Size < unit {
 		return fmt.Sprintf("%d B", f.Size)
@@ -117,82 +147,304 @@ func newGroups(fs []File) []Group {
 	return gs
 }
 
+// defaultRefreshConcurrency is how many prefix shards Cache.refresh lists
+// concurrently when REFRESH_CONCURRENCY is not set.
+const defaultRefreshConcurrency = 8
+
+func refreshConcurrency() int {
+	v := os.Getenv("REFRESH_CONCURRENCY")
+	if v == "" {
+		return defaultRefreshConcurrency
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return defaultRefreshConcurrency
+	}
+	return n
+}
+
 type Cache struct {
 	settings  settings
-	createdAt time.Time
 	template  *template.Template
+	mu        sync.RWMutex
+	createdAt time.Time
+	Files     []File
 	HTML      []byte
 	JSON      []byte
+
+	refreshing          atomic.Bool
+	refreshErrorsTotal  atomic.Int64
+	lastRefreshDuration time.Duration
+	lastRefreshErr      error
+
+	headMu    sync.Mutex
+	headCache map[headCacheKey]headInfo
+}
+
+// headCacheKey identifies a HeadObject call worth skipping: if a key's size
+// and last-modified timestamp have not changed, its metadata has not
+// changed either.
+type headCacheKey struct {
+	key          string
+	lastModified time.Time
+	size         int64
+}
+
+type headInfo struct {
+	metadata map[string]string
+}
+
+func (c *Cache) isStale() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return time.Since(c.createdAt) > staleAfter
+}
+
+func (c *Cache) isHardExpired() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return time.Since(c.createdAt) > hardExpireAfter
+}
+
+// body returns the cached JSON or HTML representation of the bucket
+// listing, guarded against a concurrent refresh.
+func (c *Cache) body(asJSON bool) []byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if asJSON {
+		return c.JSON
+	}
+	return c.HTML
+}
+
+// cacheStats is a point-in-time snapshot used by the /healthz and /metrics
+// endpoints.
+type cacheStats struct {
+	createdAt           time.Time
+	lastRefreshDuration time.Duration
+	lastRefreshErr      error
+	objects             int
+	bytes               int64
+}
+
+func (c *Cache) stats() cacheStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var bytes int64
+	for _, f := range c.Files {
+		bytes += f.Size
+	}
+	return cacheStats{
+		createdAt:           c.createdAt,
+		lastRefreshDuration: c.lastRefreshDuration,
+		lastRefreshErr:      c.lastRefreshErr,
+		objects:             len(c.Files),
+		bytes:               bytes,
+	}
 }
 
-func (c *Cache) isExpired() bool {
-	return time.Since(c.createdAt) > cacheExpiration
+// triggerBackgroundRefresh kicks off a single refresh in the background when
+// the cache is stale and no refresh is already in flight, so the request
+// that notices the staleness is not the one paying for it.
+func (c *Cache) triggerBackgroundRefresh() {
+	if !c.isStale() || !c.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer c.refreshing.Store(false)
+		if err := c.refresh(); err != nil {
+			log.Output(1, fmt.Sprintf("Error refreshing cache in background: %s", err))
+		}
+	}()
 }
 
 type JSONResponse struct {
 	Data []Group `json:"data"`
 }
 
-func (c *Cache) refresh() error {
-	var fs []File
-	sess, err := session.NewSession(&aws.Config{
-		Region:           aws.String(c.settings.region),
-		Endpoint:         aws.String(c.settings.endpointURL),
-		S3ForcePathStyle: aws.Bool(true),
-		Credentials: credentials.NewStaticCredentials(
-			c.settings.accessKey,
-			c.settings.secretAccessKey,
-			"",
-		),
+// headInfoFor returns the user metadata for obj, fetched via HeadObject and
+// cached by (Key, LastModified, Size) so an unchanged key is never
+// re-HEAD'd on a later refresh.
+func (c *Cache) headInfoFor(sdk *s3.S3, obj *s3.Object) headInfo {
+	key := headCacheKey{*obj.Key, *obj.LastModified, *obj.Size}
+
+	c.headMu.Lock()
+	info, ok := c.headCache[key]
+	c.headMu.Unlock()
+	if ok {
+		return info
+	}
+
+	r, err := sdk.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(c.settings.bucket),
+		Key:    obj.Key,
 	})
 	if err != nil {
-		return err
+		log.Output(1, fmt.Sprintf("Error fetching metadata for %s: %s", *obj.Key, err))
+	} else {
+		info.metadata = make(map[string]string, len(r.Metadata))
+		for k, v := range r.Metadata {
+			if v != nil {
+				info.metadata[strings.ToLower(k)] = *v
+			}
+		}
 	}
 
+	c.headMu.Lock()
+	c.headCache[key] = info
+	c.headMu.Unlock()
+	return info
+}
+
+func (c *Cache) toFile(sdk *s3.S3, obj *s3.Object) File {
+	f := File{
+		URL:            fmt.Sprintf("%s%s", c.settings.publicDomain, *obj.Key),
+		Size:           *obj.Size,
+		ContentType:    mime.TypeByExtension(path.Ext(*obj.Key)),
+		name:           *obj.Key,
+		lastModifiedAt: *obj.LastModified,
+	}
+	if etag := strings.Trim(*obj.ETag, `"`); !strings.Contains(etag, "-") {
+		f.ETag = etag
+	}
+	if info := c.headInfoFor(sdk, obj); len(info.metadata) > 0 {
+		f.Metadata = info.metadata
+	}
+	return f
+}
+
+// discoverShards probes the bucket with Delimiter "/" to enumerate its
+// top-level groups (the shards refresh fans out across) along with the
+// root-level objects, which have no group to shard by.
+func (c *Cache) discoverShards(sdk *s3.S3) ([]string, []File, error) {
+	var shards []string
+	var fs []File
 	var token *string
-	loadPage := func(t *string) ([]File, *string, error) {
-		var fs []File
-		sdk := s3.New(sess)
+	for {
 		r, err := sdk.ListObjectsV2(&s3.ListObjectsV2Input{
 			Bucket:            aws.String(c.settings.bucket),
-			ContinuationToken: t,
+			Delimiter:         aws.String("/"),
+			ContinuationToken: token,
 		})
 		if err != nil {
-			return []File{}, nil, err
+			return nil, nil, err
+		}
+		for _, p := range r.CommonPrefixes {
+			shards = append(shards, *p.Prefix)
 		}
 		for _, obj := range r.Contents {
-			url := fmt.Sprintf("%s%s", c.settings.publicDomain, *obj.Key)
-			fs = append(fs, File{url, *obj.Size, *obj.Key, *obj.LastModified})
+			fs = append(fs, c.toFile(sdk, obj))
 		}
-		if *r.IsTruncated {
-			return fs, r.NextContinuationToken, nil
+		if !*r.IsTruncated {
+			return shards, fs, nil
 		}
-		return fs, nil, nil
+		token = r.NextContinuationToken
 	}
+}
+
+// listShard paginates every object under prefix, streaming each one to out.
+func (c *Cache) listShard(sdk *s3.S3, prefix string, out chan<- File) error {
+	var token *string
 	for {
-		r, nxt, err := loadPage(token)
+		r, err := sdk.ListObjectsV2(&s3.ListObjectsV2Input{
+			Bucket:            aws.String(c.settings.bucket),
+			Prefix:            aws.String(prefix),
+			ContinuationToken: token,
+		})
 		if err != nil {
 			return err
 		}
-		fs = append(fs, r...)
-		if nxt == nil {
-			break
+		for _, obj := range r.Contents {
+			out <- c.toFile(sdk, obj)
 		}
-		token = nxt
+		if !*r.IsTruncated {
+			return nil
+		}
+		token = r.NextContinuationToken
+	}
+}
+
+// refresh wraps doRefresh, recording how long it took and whether it failed
+// so /healthz and /metrics can report on it.
+func (c *Cache) refresh() error {
+	start := time.Now()
+	err := c.doRefresh()
+
+	c.mu.Lock()
+	c.lastRefreshDuration = time.Since(start)
+	c.lastRefreshErr = err
+	c.mu.Unlock()
+
+	if err != nil {
+		c.refreshErrorsTotal.Add(1)
+	}
+	return err
+}
+
+func (c *Cache) doRefresh() error {
+	sess, err := session.NewSession(&aws.Config{
+		Region:           aws.String(c.settings.region),
+		Endpoint:         aws.String(c.settings.endpointURL),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials: credentials.NewStaticCredentials(
+			c.settings.accessKey,
+			c.settings.secretAccessKey,
+			"",
+		),
+	})
+	if err != nil {
+		return err
+	}
+	sdk := s3.New(sess)
+
+	shards, fs, err := c.discoverShards(sdk)
+	if err != nil {
+		return err
+	}
+
+	results := make(chan File)
+	errs := make(chan error, len(shards))
+	sem := make(chan struct{}, refreshConcurrency())
+	var wg sync.WaitGroup
+	go func() {
+		for _, p := range shards {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(prefix string) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				if err := c.listShard(sdk, prefix, results); err != nil {
+					errs <- err
+				}
+			}(p)
+		}
+		wg.Wait()
+		close(results)
+	}()
+	for f := range results {
+		fs = append(fs, f)
+	}
+	select {
+	case err := <-errs:
+		return err
+	default:
 	}
 
 	data := newGroups(fs)
 	var h bytes.Buffer
 	c.template.Execute(&h, data)
-	c.HTML = h.Bytes()
 
 	var j bytes.Buffer
 	if err := json.NewEncoder(&j).Encode(JSONResponse{data}); err != nil {
 		return err
 	}
-	c.JSON = j.Bytes()
 
+	c.mu.Lock()
+	c.Files = fs
+	c.HTML = h.Bytes()
+	c.JSON = j.Bytes()
 	c.createdAt = time.Now()
+	c.mu.Unlock()
 	return nil
 }
 
@@ -201,27 +453,61 @@ func newCache(s settings) (*Cache, error) {
 	if err != nil {
 		return nil, err
 	}
-	c := Cache{s, time.Now(), t, []byte{}, []byte{}}
+	c := Cache{
+		settings:  s,
+		template:  t,
+		createdAt: time.Now(),
+		HTML:      []byte{},
+		JSON:      []byte{},
+		headCache: make(map[headCacheKey]headInfo),
+	}
 	if err := c.refresh(); err != nil {
 		return nil, err
 	}
 	return &c, nil
 }
 
-func startServer(c *Cache, p string) {
+func startServer(c *Cache, keys auth.Keys, p string) {
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if c.isExpired() {
-			if err := c.refresh(); err != nil {
-				log.Output(1, fmt.Sprintf("Error loading files: %s", err))
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		switch r.URL.Path {
+		case "/healthz":
+			c.handleHealthz(w)
+			return
+		case "/metrics":
+			c.handleMetrics(w)
+			return
+		}
+
+		if len(keys) > 0 {
+			if err := keys.Verify(r); err != nil {
+				log.Output(1, fmt.Sprintf("Rejecting unsigned or invalid request: %s", err))
+				http.Error(w, "Forbidden", http.StatusForbidden)
 				return
 			}
 		}
 
-		if r.Header.Get("Accept") == "application/json" {
-			w.Write(c.JSON)
-		} else {
-			w.Write(c.HTML)
+		if c.isHardExpired() {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		c.triggerBackgroundRefresh()
+
+		q := r.URL.Query()
+		switch {
+		case r.URL.Path == "/checksums.txt":
+			c.handleChecksums(w)
+		case r.URL.Path == "/" && q.Get("list-type") == "2":
+			c.handleListObjectsV2(w, r)
+		case r.URL.Path == "/" && (q.Get("prefix") != "" || q.Get("delimiter") != "" || q.Get("marker") != ""):
+			c.handleListObjectsV1(w, r)
+		case r.URL.Path != "/" && r.Method == http.MethodHead:
+			c.handleHeadObject(w, strings.TrimPrefix(r.URL.Path, "/"))
+		case r.URL.Path != "/":
+			c.handleGetObject(w, r, strings.TrimPrefix(r.URL.Path, "/"))
+		case r.Header.Get("Accept") == "application/json":
+			w.Write(c.body(true))
+		default:
+			w.Write(c.body(false))
 		}
 	})
 
@@ -239,9 +525,13 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	keys, err := auth.ParseKeys(os.Getenv("MIRROR_ACCESS_KEYS"))
+	if err != nil {
+		log.Fatal(err)
+	}
 	p := os.Getenv("PORT")
 	if p == "" {
 		p = "8000"
 	}
-	startServer(c, p)
+	startServer(c, keys, p)
 }
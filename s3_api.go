@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultMaxKeys mirrors the S3 default page size for ListBucket and
+// ListObjectsV2 when the caller does not set max-keys.
+const defaultMaxKeys = 1000
+
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	Size         int64     `xml:"Size"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// listBucketResult is the XML body for the legacy (V1) GET Bucket (List
+// Objects) API.
+type listBucketResult struct {
+	XMLName        xml.Name         `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name           string           `xml:"Name"`
+	Prefix         string           `xml:"Prefix"`
+	Marker         string           `xml:"Marker,omitempty"`
+	NextMarker     string           `xml:"NextMarker,omitempty"`
+	MaxKeys        int              `xml:"MaxKeys"`
+	Delimiter      string           `xml:"Delimiter,omitempty"`
+	IsTruncated    bool             `xml:"IsTruncated"`
+	Contents       []s3Object       `xml:"Contents"`
+	CommonPrefixes []s3CommonPrefix `xml:"CommonPrefixes,omitempty"`
+}
+
+// listBucketResultV2 is the XML body for ListObjectsV2 (list-type=2).
+type listBucketResultV2 struct {
+	XMLName               xml.Name         `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	KeyCount              int              `xml:"KeyCount"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes,omitempty"`
+}
+
+// fileByKey returns the cached File whose name matches key.
+func (c *Cache) fileByKey(key string) (*File, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for i := range c.Files {
+		if c.Files[i].name == key {
+			return &c.Files[i], true
+		}
+	}
+	return nil, false
+}
+
+// listEntry is either an object or a rolled-up common prefix, tagged with
+// the key S3 would sort and paginate it by.
+type listEntry struct {
+	key    string
+	object *s3Object
+	prefix *s3CommonPrefix
+}
+
+// filterByPrefix returns, in key order, the objects under prefix and, when
+// delimiter is set, rolls up everything past the first delimiter occurrence
+// into a common prefix entry -- the same grouping File.group() does for
+// "/". Objects and common prefixes share one ordered list because S3 counts
+// and paginates both against the same MaxKeys/marker budget.
+func (c *Cache) filterByPrefix(prefix, delimiter string) []listEntry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ks := make([]string, len(c.Files))
+	byName := make(map[string]*File, len(c.Files))
+	for i, f := range c.Files {
+		ks[i] = f.name
+		byName[f.name] = &c.Files[i]
+	}
+	sort.Strings(ks)
+
+	var entries []listEntry
+	seen := make(map[string]bool)
+	for _, k := range ks {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		rest := k[len(prefix):]
+		if delimiter != "" {
+			if i := strings.Index(rest, delimiter); i >= 0 {
+				p := prefix + rest[:i+len(delimiter)]
+				if !seen[p] {
+					seen[p] = true
+					entries = append(entries, listEntry{key: p, prefix: &s3CommonPrefix{Prefix: p}})
+				}
+				continue
+			}
+		}
+		f := byName[k]
+		entries = append(entries, listEntry{
+			key:    k,
+			object: &s3Object{Key: k, LastModified: f.lastModifiedAt, Size: f.Size},
+		})
+	}
+	return entries
+}
+
+// splitEntries separates a (already key-budgeted) slice of entries back
+// into the Contents/CommonPrefixes the XML response needs.
+func splitEntries(entries []listEntry) ([]s3Object, []s3CommonPrefix) {
+	var objects []s3Object
+	var prefixes []s3CommonPrefix
+	for _, e := range entries {
+		if e.object != nil {
+			objects = append(objects, *e.object)
+		} else {
+			prefixes = append(prefixes, *e.prefix)
+		}
+	}
+	return objects, prefixes
+}
+
+// maxKeys reads max-keys from the query string, falling back to
+// defaultMaxKeys when it is missing or out of range.
+func maxKeys(r *http.Request) int {
+	if v := r.URL.Query().Get("max-keys"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= defaultMaxKeys {
+			return n
+		}
+	}
+	return defaultMaxKeys
+}
+
+// writeXML renders v as an XML document with the standard XML declaration.
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		log.Output(1, fmt.Sprintf("Error encoding XML response: %s", err))
+	}
+}
+
+// handleListObjectsV1 serves GET /?prefix=&delimiter=&marker= using the
+// legacy S3 ListBucket (V1) response schema.
+func (c *Cache) handleListObjectsV1(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+	marker := q.Get("marker")
+	max := maxKeys(r)
+
+	entries := c.filterByPrefix(prefix, delimiter)
+	if marker != "" {
+		start := len(entries)
+		for i, e := range entries {
+			if e.key > marker {
+				start = i
+				break
+			}
+		}
+		entries = entries[start:]
+	}
+
+	var nextMarker string
+	truncated := len(entries) > max
+	if truncated {
+		entries = entries[:max]
+		nextMarker = entries[max-1].key
+	}
+	objects, prefixes := splitEntries(entries)
+
+	writeXML(w, listBucketResult{
+		Name:           c.settings.bucket,
+		Prefix:         prefix,
+		Marker:         marker,
+		NextMarker:     nextMarker,
+		MaxKeys:        max,
+		Delimiter:      delimiter,
+		IsTruncated:    truncated,
+		Contents:       objects,
+		CommonPrefixes: prefixes,
+	})
+}
+
+// handleListObjectsV2 serves GET /?list-type=2&continuation-token= using the
+// ListObjectsV2 response schema.
+func (c *Cache) handleListObjectsV2(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+	token := q.Get("continuation-token")
+	max := maxKeys(r)
+
+	entries := c.filterByPrefix(prefix, delimiter)
+	if token != "" {
+		start := len(entries)
+		for i, e := range entries {
+			if e.key > token {
+				start = i
+				break
+			}
+		}
+		entries = entries[start:]
+	}
+
+	var next string
+	truncated := len(entries) > max
+	if truncated {
+		entries = entries[:max]
+		next = entries[max-1].key
+	}
+	objects, prefixes := splitEntries(entries)
+
+	writeXML(w, listBucketResultV2{
+		Name:                  c.settings.bucket,
+		Prefix:                prefix,
+		KeyCount:              len(entries),
+		MaxKeys:               max,
+		Delimiter:             delimiter,
+		IsTruncated:           truncated,
+		ContinuationToken:     token,
+		NextContinuationToken: next,
+		Contents:              objects,
+		CommonPrefixes:        prefixes,
+	})
+}
+
+// handleHeadObject serves HEAD /<key>, reporting size and last-modified
+// without issuing a request against the backing bucket.
+func (c *Cache) handleHeadObject(w http.ResponseWriter, key string) {
+	f, ok := c.fileByKey(key)
+	if !ok {
+		http.NotFound(w, nil)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(f.Size, 10))
+	w.Header().Set("Last-Modified", f.lastModifiedAt.UTC().Format(http.TimeFormat))
+}
+
+// handleGetObject serves GET /<key> by redirecting to the object's public
+// URL so downloads are served straight from the bucket.
+func (c *Cache) handleGetObject(w http.ResponseWriter, r *http.Request, key string) {
+	f, ok := c.fileByKey(key)
+	if !ok {
+		http.NotFound(w, nil)
+		return
+	}
+	http.Redirect(w, r, f.URL, http.StatusFound)
+}